@@ -0,0 +1,173 @@
+package replay
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checkpoint persists a replay's progress (the ID of a completed loadspec entry and the offset
+// into the loadspec below which every entry has completed) to a single-line file, fsynced every
+// --checkpoint_every_n advances or --checkpoint_every, whichever comes first. A --resume_from
+// restart reads it back to seek past already-completed entries. A zero-value Checkpoint (path == "") is a no-op, so callers never
+// need to branch on whether checkpointing is enabled.
+type Checkpoint struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	everyN    int
+	everyT    time.Duration
+	count     int
+	lastFlush time.Time
+	id        int64
+	offset    int64
+}
+
+// NewCheckpoint opens (creating if needed) the checkpoint file at path. When path is empty,
+// checkpointing is disabled and the returned Checkpoint's methods are no-ops.
+func NewCheckpoint(path string, everyN int, everyT time.Duration) (*Checkpoint, error) {
+	if path == "" {
+		return &Checkpoint{}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Checkpoint{
+		path:      path,
+		file:      f,
+		everyN:    everyN,
+		everyT:    everyT,
+		lastFlush: time.Now(),
+	}, nil
+}
+
+func (c *Checkpoint) enabled() bool {
+	return c.path != ""
+}
+
+// Record updates the in-memory progress to (id, offset), flushing to disk once --checkpoint_every_n
+// entries have been recorded since the last flush or --checkpoint_every has elapsed, whichever
+// comes first. Completions from different targets can call Record concurrently and out of order,
+// so an offset that doesn't advance progress is ignored rather than rewinding it.
+func (c *Checkpoint) Record(id, offset int64) error {
+	if !c.enabled() {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if offset <= c.offset {
+		return nil
+	}
+	c.id, c.offset = id, offset
+	c.count++
+	if c.count < c.everyN && time.Since(c.lastFlush) < c.everyT {
+		return nil
+	}
+	return c.flushLocked()
+}
+
+func (c *Checkpoint) flushLocked() error {
+	if err := c.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := c.file.Seek(0, 0); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.file, "%d,%d\n", c.id, c.offset); err != nil {
+		return err
+	}
+	if err := c.file.Sync(); err != nil {
+		return err
+	}
+	c.count = 0
+	c.lastFlush = time.Now()
+	return nil
+}
+
+// Close flushes any progress recorded since the last fsync and closes the checkpoint file. It
+// satisfies the Shutdown coordinator's closer interface, so the final position is never lost to
+// the --checkpoint_every_n/--checkpoint_every batching window on a graceful shutdown.
+func (c *Checkpoint) Close() error {
+	if !c.enabled() {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.flushLocked(); err != nil {
+		return err
+	}
+	return c.file.Close()
+}
+
+// Load reads back the last persisted id/offset pair, for a --resume_from restart. It returns
+// (0, 0, nil) for an empty file, e.g. one created by NewCheckpoint but never flushed to.
+func (c *Checkpoint) Load() (id int64, offset int64, err error) {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	line := strings.TrimSpace(string(data))
+	if line == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(line, ",", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed checkpoint line %q", line)
+	}
+	if id, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if offset, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	// Seeding the in-memory progress, so a Close before any new Record keeps this position.
+	c.mu.Lock()
+	c.id, c.offset = id, offset
+	c.mu.Unlock()
+	return id, offset, nil
+}
+
+// offsetTracker reconciles checkpoint offsets with out-of-order completion across targets: the
+// dispatch loop calls Dispatch as soon as an entry is handed to a target, but that offset is only
+// safe to persist once every entry dispatched at or before it has also completed, since a target
+// that's still working on an earlier entry could still crash before finishing it.
+type offsetTracker struct {
+	mu                sync.Mutex
+	inFlight          map[int64]struct{}
+	highestDispatched int64
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{inFlight: make(map[int64]struct{})}
+}
+
+// Dispatch marks offset as in flight.
+func (t *offsetTracker) Dispatch(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight[offset] = struct{}{}
+	if offset > t.highestDispatched {
+		t.highestDispatched = offset
+	}
+}
+
+// Complete marks offset as finished and returns the offset that's now safe to checkpoint. Dispatch
+// is always called in increasing offset order, so every offset below the lowest one still in
+// flight is guaranteed to have completed already: the safe offset is one less than that (or
+// highestDispatched, once nothing is in flight anymore).
+func (t *offsetTracker) Complete(offset int64) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inFlight, offset)
+	safe := t.highestDispatched
+	for o := range t.inFlight {
+		if o-1 < safe {
+			safe = o - 1
+		}
+	}
+	return safe
+}
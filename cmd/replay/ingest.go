@@ -0,0 +1,114 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/danielfireman/esperf/loadspec"
+)
+
+// loadspecReader scans loadspec entries, one JSON object per line, from stdin or --loadspec_file.
+type loadspecReader struct {
+	scanner *bufio.Scanner
+	closer  io.Closer
+}
+
+// newLoadspecReader opens path (or stdin, when path is empty) for reading.
+func newLoadspecReader(path string) (*loadspecReader, error) {
+	if path == "" {
+		return &loadspecReader{scanner: bufio.NewScanner(os.Stdin), closer: os.Stdin}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &loadspecReader{scanner: bufio.NewScanner(f), closer: f}, nil
+}
+
+// next decodes the next entry. ok is false once the input is exhausted.
+func (lr *loadspecReader) next() (entry loadspec.Entry, ok bool, err error) {
+	if !lr.scanner.Scan() {
+		return loadspec.Entry{}, false, lr.scanner.Err()
+	}
+	if err := json.NewDecoder(strings.NewReader(lr.scanner.Text())).Decode(&entry); err != nil {
+		return loadspec.Entry{}, false, err
+	}
+	return entry, true, nil
+}
+
+func (lr *loadspecReader) Close() error {
+	return lr.closer.Close()
+}
+
+// loadEntries returns the channel the dispatch loop reads loadspec entries from. With --preload,
+// it reads the whole loadspec synchronously upfront, matching the tool's original behavior. By
+// default it streams: a --warmup_prefetch entries are read synchronously to avoid a disk stall
+// right as dispatch starts, then a producer goroutine keeps the --prefetch-sized channel topped
+// up, propagating a malformed line or read error through shutdown instead of panicking or
+// blocking forever.
+func (r *runner) loadEntries(shutdown *Shutdown) (<-chan loadspec.Entry, error) {
+	lr, err := newLoadspecReader(loadspecFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if preload {
+		defer lr.Close()
+		var book []loadspec.Entry
+		for {
+			entry, ok, err := lr.next()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			book = append(book, entry)
+		}
+		entries := make(chan loadspec.Entry, len(book))
+		for _, entry := range book {
+			entries <- entry
+		}
+		close(entries)
+		return entries, nil
+	}
+
+	entries := make(chan loadspec.Entry, prefetch)
+	for i := 0; i < warmupPrefetch; i++ {
+		entry, ok, err := lr.next()
+		if err != nil {
+			lr.Close()
+			return nil, err
+		}
+		if !ok {
+			close(entries)
+			lr.Close()
+			return entries, nil
+		}
+		entries <- entry
+	}
+	go func() {
+		defer close(entries)
+		defer lr.Close()
+		for {
+			entry, ok, err := lr.next()
+			if err != nil {
+				shutdown.Fail(fmt.Errorf("reading loadspec: %v", err))
+				return
+			}
+			if !ok {
+				return
+			}
+			select {
+			case entries <- entry:
+			case <-shutdown.Done():
+				return
+			}
+		}
+	}()
+	return entries, nil
+}
@@ -0,0 +1,131 @@
+package replay
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielfireman/esperf/loadspec"
+)
+
+// Pacer decides how long the dispatch loop should wait after prev before sending entry, replacing
+// entry.DelaySinceLastNanos as the sole source of timing so a capture can be re-paced without
+// being regenerated. Taking entry directly, rather than an index into the entries seen so far,
+// keeps pacing compatible with streaming ingest: no pacer needs to retain entries it has already
+// dispatched.
+type Pacer interface {
+	Next(prev time.Time, entry loadspec.Entry) time.Duration
+}
+
+// releaser is implemented by pacers that bound concurrency with a semaphore acquired in Next;
+// Release is called once the corresponding request completes or is dropped.
+type releaser interface {
+	Release()
+}
+
+// asRecordedPacer is the default --pacing=asrecorded behavior: reproduce the capture's original
+// timing via each entry's recorded DelaySinceLastNanos.
+type asRecordedPacer struct{}
+
+func (p *asRecordedPacer) Next(prev time.Time, entry loadspec.Entry) time.Duration {
+	return time.Duration(entry.DelaySinceLastNanos)
+}
+
+// constantPacer dispatches at a fixed rate, ignoring recorded delays.
+type constantPacer struct {
+	interval time.Duration
+}
+
+func newConstantPacer(rps float64) *constantPacer {
+	return &constantPacer{interval: time.Duration(float64(time.Second) / rps)}
+}
+
+func (p *constantPacer) Next(prev time.Time, entry loadspec.Entry) time.Duration {
+	return p.interval
+}
+
+// poissonPacer samples inter-arrival times from an exponential distribution with rate lambda
+// requests/second, producing a Poisson arrival process.
+type poissonPacer struct {
+	lambda float64
+}
+
+func newPoissonPacer(rps float64) *poissonPacer {
+	return &poissonPacer{lambda: rps}
+}
+
+func (p *poissonPacer) Next(prev time.Time, entry loadspec.Entry) time.Duration {
+	u := rand.Float64()
+	for u == 0 { // guard: ln(1-0) is 0, which would yield a zero inter-arrival time.
+		u = rand.Float64()
+	}
+	return time.Duration(-math.Log(1-u) / p.lambda * float64(time.Second))
+}
+
+// closedPacer ignores recorded delays entirely and instead bounds the replay to n in-flight
+// requests: Next blocks until a slot is free and returns no additional delay, while Release
+// (called once a request completes, or by the dispatch loop immediately if it was dropped during
+// a target pause) frees the slot back up.
+type closedPacer struct {
+	sem chan struct{}
+}
+
+func newClosedPacer(n int) *closedPacer {
+	return &closedPacer{sem: make(chan struct{}, n)}
+}
+
+func (p *closedPacer) Next(prev time.Time, entry loadspec.Entry) time.Duration {
+	p.sem <- struct{}{}
+	return 0
+}
+
+func (p *closedPacer) Release() {
+	<-p.sem
+}
+
+// newPacer parses --pacing into the Pacer it names. asrecorded is also the default when spec is
+// empty.
+func newPacer(spec string) (Pacer, error) {
+	if spec == "" || spec == "asrecorded" {
+		return &asRecordedPacer{}, nil
+	}
+	mode, arg, ok := cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid --pacing %q: expected asrecorded, constant:<rps>, poisson:<rps> or closed:<n>", spec)
+	}
+	switch mode {
+	case "constant":
+		rps, err := strconv.ParseFloat(arg, 64)
+		if err != nil || rps <= 0 {
+			return nil, fmt.Errorf("invalid --pacing %q: rps must be a positive number", spec)
+		}
+		return newConstantPacer(rps), nil
+	case "poisson":
+		rps, err := strconv.ParseFloat(arg, 64)
+		if err != nil || rps <= 0 {
+			return nil, fmt.Errorf("invalid --pacing %q: rps must be a positive number", spec)
+		}
+		return newPoissonPacer(rps), nil
+	case "closed":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid --pacing %q: n must be a positive integer", spec)
+		}
+		return newClosedPacer(n), nil
+	default:
+		return nil, fmt.Errorf("invalid --pacing %q: must be asrecorded, constant:<rps>, poisson:<rps> or closed:<n>", spec)
+	}
+}
+
+// cut splits spec on the first occurrence of sep, mirroring strings.Cut for this codebase's
+// (pre-1.18) Go version.
+func cut(spec, sep string) (before, after string, found bool) {
+	i := strings.Index(spec, sep)
+	if i < 0 {
+		return spec, "", false
+	}
+	return spec[:i], spec[i+len(sep):], true
+}
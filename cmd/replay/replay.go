@@ -2,14 +2,17 @@ package replay
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -25,15 +28,29 @@ import (
 )
 
 var (
-	host          string
-	resultsPath   string
-	expID         string
-	cint          time.Duration
-	timeout       time.Duration
-	debug         bool
-	numClients    int
-	isPaused      int32
-	continueOn400 bool
+	host                string
+	resultsPath         string
+	expID               string
+	cint                time.Duration
+	timeout             time.Duration
+	debug               bool
+	numClients          int
+	continueOn400       bool
+	compression         string
+	compressionMinBytes int
+	targetsFlag         string
+	targetsFile         string
+	maxBackoff          time.Duration
+	shutdownTimeout     time.Duration
+	checkpointPath      string
+	checkpointEveryN    int
+	checkpointEvery     time.Duration
+	resumeFrom          bool
+	pacing              string
+	loadspecFile        string
+	prefetch            int
+	warmupPrefetch      int
+	preload             bool
 )
 
 func init() {
@@ -45,6 +62,21 @@ func init() {
 	RootCmd.Flags().BoolVar(&debug, "debug", false, "Dump requests and responses.")
 	RootCmd.Flags().IntVarP(&numClients, "num_clients", "c", 10, "Number of active clients making requests.")
 	RootCmd.Flags().BoolVar(&continueOn400, "continue_on_400s", false, "Whether the loadtest should continue if it receives a 400 response.")
+	RootCmd.Flags().StringVar(&compression, "compression", "auto", "Request body compression mode: auto, gzip or none.")
+	RootCmd.Flags().IntVar(&compressionMinBytes, "compression_min_bytes", 512, "In auto mode, minimum body size in bytes before gzip is applied.")
+	RootCmd.Flags().StringVar(&targetsFlag, "targets", "", "Comma-separated list of Elasticsearch endpoints to replay against. Defaults to the URLs already present in the loadspec entries.")
+	RootCmd.Flags().StringVar(&targetsFile, "targets_file", "", "File with one Elasticsearch endpoint per line. Combined with --targets if both are set.")
+	RootCmd.Flags().DurationVar(&maxBackoff, "max_backoff", 30*time.Second, "Upper bound for the exponential backoff applied to a target after repeated 5xx responses.")
+	RootCmd.Flags().DurationVar(&shutdownTimeout, "shutdown_timeout", 10*time.Second, "How long to wait for in-flight requests and report writers to drain on shutdown before forcing connections closed.")
+	RootCmd.Flags().StringVar(&checkpointPath, "checkpoint_path", "", "File to persist replay progress to. Required for --resume_from. Disabled when empty.")
+	RootCmd.Flags().IntVar(&checkpointEveryN, "checkpoint_every_n", 1000, "Fsync the checkpoint file after the checkpointed offset has advanced this many times.")
+	RootCmd.Flags().DurationVar(&checkpointEvery, "checkpoint_every", 5*time.Second, "Fsync the checkpoint file at least this often, regardless of --checkpoint_every_n.")
+	RootCmd.Flags().BoolVar(&resumeFrom, "resume_from", false, "Resume a crashed or interrupted replay from --checkpoint_path, skipping already-completed entries.")
+	RootCmd.Flags().StringVar(&pacing, "pacing", "asrecorded", "Dispatch pacing: asrecorded, constant:<rps>, poisson:<rps> or closed:<n>.")
+	RootCmd.Flags().StringVar(&loadspecFile, "loadspec_file", "", "File to read the loadspec from. Defaults to stdin.")
+	RootCmd.Flags().IntVar(&prefetch, "prefetch", 10000, "Size of the bounded channel loadspec entries are streamed into ahead of dispatch.")
+	RootCmd.Flags().IntVar(&warmupPrefetch, "warmup_prefetch", 1000, "Entries to read synchronously before the dispatch loop starts, to avoid a disk stall at t=0.")
+	RootCmd.Flags().BoolVar(&preload, "preload", false, "Load the entire loadspec into memory upfront instead of streaming it, matching the tool's original behavior.")
 }
 
 var (
@@ -53,7 +85,10 @@ var (
 	// DefaultConnections is the default amount of max open idle connections per
 	// target host.
 	defaultConnections = 10000
-	r                  runner
+	// baseBackoff is the starting point for the exponential backoff applied on repeated 5xx
+	// responses from a target, before the jitter and the --max_backoff cap are applied.
+	baseBackoff = 500 * time.Millisecond
+	r           runner
 )
 
 var RootCmd = &cobra.Command{
@@ -71,26 +106,52 @@ var RootCmd = &cobra.Command{
 			return fmt.Errorf("results path can not be empty. Please set --results_path flag.")
 		}
 
+		switch compression {
+		case "auto", "gzip", "none":
+		default:
+			return fmt.Errorf("invalid --compression value %q: must be one of auto, gzip, none", compression)
+		}
+
+		if warmupPrefetch > prefetch {
+			return fmt.Errorf("--warmup_prefetch (%d) can not be greater than --prefetch (%d)", warmupPrefetch, prefetch)
+		}
+
+		hosts, err := parseTargets(targetsFlag, targetsFile)
+		if err != nil {
+			return err
+		}
+		r.targets, err = newTargets(hosts, numClients)
+		if err != nil {
+			return err
+		}
+
 		r.requestsSent = metrics.NewCounter()
-		r.errors = metrics.NewCounter()
 		r.responseTimes = metrics.NewHistogram()
-		r.pauseTimes = metrics.NewHistogram()
-		r.clients = make(chan *http.Client, numClients)
-		for i := 0; i < numClients; i++ {
-			r.clients <- &http.Client{
-				Transport: &http.Transport{
-					Dial: (&net.Dialer{
-						LocalAddr: &net.TCPAddr{IP: defaultLocalAddr.IP, Zone: defaultLocalAddr.Zone},
-						KeepAlive: 3 * timeout,
-						Timeout:   timeout,
-					}).Dial,
-					ResponseHeaderTimeout: timeout,
-					MaxIdleConnsPerHost:   defaultConnections,
-				},
+		r.compressedBytes = metrics.NewHistogram()
+		r.uncompressedBytes = metrics.NewHistogram()
+		r.pacingIntervals = metrics.NewHistogram()
+
+		if resumeFrom && checkpointPath == "" {
+			return fmt.Errorf("--resume_from requires --checkpoint_path to be set")
+		}
+		r.checkpoint, err = NewCheckpoint(checkpointPath, checkpointEveryN, checkpointEvery)
+		if err != nil {
+			return err
+		}
+		requestReportPath := csvFilePath("request", expID, resultsPath)
+		if resumeFrom {
+			lastID, offset, err := r.checkpoint.Load()
+			if err != nil {
+				return fmt.Errorf("loading checkpoint %q: %v", checkpointPath, err)
+			}
+			if err := truncateValidTail(requestReportPath); err != nil {
+				return fmt.Errorf("truncating per-request report %q: %v", requestReportPath, err)
 			}
+			r.resumeOffset = offset
+			fmt.Printf("Resuming from entry id %d (loadspec offset %d).\n", lastID, offset)
 		}
 
-		r.perRequest, err = reporter.NewPerRequestReport(csvFilePath("request", expID, resultsPath))
+		r.perRequest, err = reporter.NewPerRequestReport(requestReportPath)
 		if err != nil {
 			return err
 		}
@@ -100,13 +161,12 @@ var RootCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		r.report, err = reporter.New(
-			cint,
-			timeout,
+		reportOpts := []reporter.Option{
 			reporter.MetricToCSV(r.responseTimes, csvFilePath("response.time", expID, resultsPath)),
-			reporter.MetricToCSV(r.pauseTimes, csvFilePath("pause.time", expID, resultsPath)),
 			reporter.MetricToCSV(r.requestsSent, csvFilePath("requests.sent", expID, resultsPath)),
-			reporter.MetricToCSV(r.errors, csvFilePath("errors", expID, resultsPath)),
+			reporter.MetricToCSV(r.pacingIntervals, csvFilePath("pacing", expID, resultsPath)),
+			reporter.MetricToCSV(r.compressedBytes, csvFilePath("compressed.bytes", expID, resultsPath)),
+			reporter.MetricToCSV(r.uncompressedBytes, csvFilePath("uncompressed.bytes", expID, resultsPath)),
 			reporter.AddCollector(collector),
 			reporter.MetricToCSV(collector.Mem.YoungHeapPool, csvFilePath("mem.young", expID, resultsPath)),
 			reporter.MetricToCSV(collector.Mem.TenuredHeapPool, csvFilePath("mem.tenured", expID, resultsPath)),
@@ -118,7 +178,14 @@ var RootCmd = &cobra.Command{
 			reporter.MetricToCSV(collector.CPU, csvFilePath("cpu", expID, resultsPath)),
 			reporter.MetricToCSV(collector.GC.Young, csvFilePath("gc.young", expID, resultsPath)),
 			reporter.MetricToCSV(collector.GC.Full, csvFilePath("gc.full", expID, resultsPath)),
-		)
+		}
+		for _, tgt := range r.targets {
+			reportOpts = append(reportOpts,
+				reporter.MetricToCSV(tgt.errors, csvFilePath(targetMetricName("errors", tgt.label), expID, resultsPath)),
+				reporter.MetricToCSV(tgt.pauseTimes, csvFilePath(targetMetricName("pause.time", tgt.label), expID, resultsPath)),
+			)
+		}
+		r.report, err = reporter.New(cint, timeout, reportOpts...)
 		if err != nil {
 			return err
 		}
@@ -133,197 +200,562 @@ var RootCmd = &cobra.Command{
 }
 
 type runner struct {
-	clients chan *http.Client
+	targets []*target
 	report  *reporter.Reporter
 
-	requestsSent  *metrics.Counter
-	responseTimes *metrics.Histogram
-	errors        *metrics.Counter
-	pauseTimes    *metrics.Histogram
-	perRequest    *reporter.PerRequestReport
+	requestsSent      *metrics.Counter
+	responseTimes     *metrics.Histogram
+	compressedBytes   *metrics.Histogram
+	uncompressedBytes *metrics.Histogram
+	pacingIntervals   *metrics.Histogram
+	perRequest        *reporter.PerRequestReport
+
+	checkpoint   *Checkpoint
+	resumeOffset int64 // set by --resume_from; the first resumeOffset loadspec entries are skipped.
+	offsets      *offsetTracker
+}
+
+// clientConn pairs an HTTP client with its own gzip.Writer, so compressing a
+// request body never allocates a new writer per request.
+type clientConn struct {
+	client *http.Client
+	gzw    *gzip.Writer
+}
+
+// target represents a single Elasticsearch endpoint being replayed against. Every target owns
+// its own client pool, pause state and backoff counter so that a 429/503/5xx response from one
+// node only throttles requests aimed at that node, instead of the whole replay.
+type target struct {
+	label   string
+	baseURL *url.URL // nil when entry.URL should be sent as-is (no --targets/--targets_file set).
+
+	clients  chan *clientConn
+	all      []*clientConn // every clientConn owned by this target, checked out or not.
+	queue    chan dispatchJob
+	isPaused int32
+	backoff  uint32 // consecutive 5xx count, used to compute the exponential backoff delay.
+
+	errors     *metrics.Counter
+	pauseTimes *metrics.Histogram
+}
+
+// Close closes every idle connection held by this target's clients, so a shutdown doesn't block
+// on a transport that's sitting on an open keep-alive with nothing in flight. It never touches
+// connections actively serving a request, so it's safe to call before in-flight work has drained.
+func (t *target) Close() error {
+	for _, conn := range t.all {
+		if tr, ok := conn.client.Transport.(*http.Transport); ok {
+			tr.CloseIdleConnections()
+		}
+	}
+	return nil
+}
+
+// rewriteURL replaces the scheme and host of raw with the target's, preserving path and query.
+// If the target has no baseURL (the default, single-implicit-target mode), raw is returned as-is.
+func (t *target) rewriteURL(raw string) (string, error) {
+	if t.baseURL == nil {
+		return raw, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = t.baseURL.Scheme
+	u.Host = t.baseURL.Host
+	return u.String(), nil
+}
+
+// dispatchJob is what the dispatch loop hands off to a target's consumeTarget goroutine: the entry
+// to send, and doneOffset, the checkpoint offset that becomes safe to persist once every entry
+// dispatched at or before it has completed. Targets complete out of order, so doneOffset is
+// reconciled against completions from every target via offsetTracker, not recorded the moment
+// this entry is popped off entries.
+type dispatchJob struct {
+	entry      loadspec.Entry
+	doneOffset int64
+}
+
+// pauseEvent is sent by a worker goroutine to ask the dispatch loop to skip entries routed to
+// tgt, in wall-clock time, for dur.
+type pauseEvent struct {
+	tgt *target
+	dur time.Duration
+}
+
+func parseTargets(targetsFlag, targetsFile string) ([]string, error) {
+	var hosts []string
+	if targetsFile != "" {
+		f, err := os.Open(targetsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if h := strings.TrimSpace(scanner.Text()); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if targetsFlag != "" {
+		for _, h := range strings.Split(targetsFlag, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// newTargets builds one target per host, each with its own pool of clientsPerHost clients. When
+// hosts is empty, it returns a single implicit target that sends loadspec entries unmodified,
+// preserving the tool's original single-target behavior.
+func newTargets(hosts []string, clientsPerHost int) ([]*target, error) {
+	var targets []*target
+	if len(hosts) == 0 {
+		targets = []*target{newTarget("")}
+	} else {
+		targets = make([]*target, 0, len(hosts))
+		for _, h := range hosts {
+			u, err := url.Parse(h)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target %q: %v", h, err)
+			}
+			tgt := newTarget(targetLabel(u))
+			tgt.baseURL = u
+			targets = append(targets, tgt)
+		}
+	}
+	for _, tgt := range targets {
+		for i := 0; i < clientsPerHost; i++ {
+			conn := newClientConn()
+			tgt.all = append(tgt.all, conn)
+			tgt.clients <- conn
+		}
+	}
+	return targets, nil
+}
+
+func newTarget(label string) *target {
+	return &target{
+		label:      label,
+		clients:    make(chan *clientConn, numClients),
+		queue:      make(chan dispatchJob, numClients),
+		errors:     metrics.NewCounter(),
+		pauseTimes: metrics.NewHistogram(),
+	}
+}
+
+func newClientConn() *clientConn {
+	return &clientConn{
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: (&net.Dialer{
+					LocalAddr: &net.TCPAddr{IP: defaultLocalAddr.IP, Zone: defaultLocalAddr.Zone},
+					KeepAlive: 3 * timeout,
+					Timeout:   timeout,
+				}).Dial,
+				ResponseHeaderTimeout: timeout,
+				MaxIdleConnsPerHost:   defaultConnections,
+			},
+		},
+		gzw: gzip.NewWriter(nil),
+	}
+}
+
+// targetLabel derives a filesystem and CSV-safe label from a target's base URL, used to suffix
+// per-host report files and to identify the target in log output.
+func targetLabel(u *url.URL) string {
+	replacer := strings.NewReplacer(":", "_", "/", "_")
+	return replacer.Replace(u.Host)
+}
+
+// targetMetricName suffixes metric with the target's label, unless the replay is running against
+// a single implicit target, in which case the original unsuffixed file name is kept.
+func targetMetricName(metric, label string) string {
+	if label == "" {
+		return metric
+	}
+	return metric + "_" + label
 }
 
 func csvFilePath(name, expID, resultsPath string) string {
 	return filepath.Join(resultsPath, name+"_"+expID+".csv")
 }
 
+// truncateValidTail drops any trailing partial line from path, e.g. a per-request report
+// interrupted mid-write by a crash, so it's safe to append to after a --resume_from restart.
+func truncateValidTail(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+	return os.Truncate(path, int64(bytes.LastIndexByte(data, '\n')+1))
+}
+
+// compressBody returns the request body to send and the Content-Encoding header value (empty
+// if the body is sent uncompressed). gzw is reused across calls to avoid allocating a new
+// gzip.Writer per request. compressedBytes/uncompressedBytes record the actual bytes sent over
+// the wire in each mode, so --results_path's CSVs measure bandwidth savings, not request counts.
+func (r *runner) compressBody(gzw *gzip.Writer, source string) (*strings.Reader, string) {
+	if compression == "none" {
+		r.uncompressedBytes.Record(int64(len(source)))
+		return strings.NewReader(source), ""
+	}
+	if compression == "auto" && len(source) < compressionMinBytes {
+		r.uncompressedBytes.Record(int64(len(source)))
+		return strings.NewReader(source), ""
+	}
+
+	var buf bytes.Buffer
+	gzw.Reset(&buf)
+	// Ignoring errors: writing to a bytes.Buffer never fails.
+	gzw.Write([]byte(source))
+	gzw.Close()
+	r.compressedBytes.Record(int64(buf.Len()))
+	return strings.NewReader(buf.String()), "gzip"
+}
+
+// selectTarget returns the target the next entry should be sent to, round-robin via next.
+// loadspec.Entry carries no per-entry target hint, so every --targets/--targets_file host gets an
+// even share of dispatched entries regardless of what's in the capture.
+func (r *runner) selectTarget(next *uint64) *target {
+	i := atomic.AddUint64(next, 1) - 1
+	return r.targets[i%uint64(len(r.targets))]
+}
+
+// backoffDelay computes the exponential-with-jitter backoff for a target's n-th consecutive 5xx,
+// capped at --max_backoff.
+func backoffDelay(n uint32) time.Duration {
+	d := baseBackoff << n
+	if d <= 0 || d > maxBackoff { // d<=0 covers the left-shift overflow on long failure streaks.
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2+1)))
+}
+
 func (r *runner) Run() error {
 	r.report.Start()
-	defer r.report.Finish()
 	r.perRequest.Start()
-	defer r.perRequest.Finish()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdown := NewShutdown(ctx, cancel, shutdownTimeout)
+	shutdown.Register(closerFunc(func() error { r.report.Finish(); return nil }))
+	shutdown.Register(closerFunc(func() error { r.perRequest.Finish(); return nil }))
+	shutdown.Register(r.checkpoint)
+	for _, tgt := range r.targets {
+		shutdown.Register(tgt)
+	}
 
 	var wg sync.WaitGroup
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, os.Kill)
-
-	// Loading the whole load in memory upfront. This avoid glitches due to disk being slow during high load
-	// replays.
-	var replayBook []loadspec.Entry
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		entry := loadspec.Entry{}
-		if err := json.NewDecoder(strings.NewReader(scanner.Text())).Decode(&entry); err != nil {
-			return err
+	// done is closed once every dispatched request has finished. Closing it immediately on a
+	// setup failure, before any request is dispatched, lets every early-return path below go
+	// through shutdown.Wait so the registered closers (report/perRequest Finish, checkpoint,
+	// targets) still run instead of being skipped by a bare return.
+	done := make(chan struct{})
+
+	entries, err := r.loadEntries(shutdown)
+	if err != nil {
+		shutdown.Fail(err)
+		close(done)
+		return shutdown.Wait(done, r.forceCloseIdle)
+	}
+	// Seeking past already-completed entries on a --resume_from restart.
+	for skipped := int64(0); skipped < r.resumeOffset; skipped++ {
+		if _, ok := <-entries; !ok {
+			break
 		}
-		replayBook = append(replayBook, entry)
 	}
 
+	pacer, err := newPacer(pacing)
+	if err != nil {
+		shutdown.Fail(err)
+		close(done)
+		return shutdown.Wait(done, r.forceCloseIdle)
+	}
+	pacerRel, isReleasingPacer := pacer.(releaser)
+
 	// Note: Having a single worker or a single load generator is a way to guarantee the load will obey to a
 	// certain  distribution. For instance, 10 workers generating load following a Poisson distribution is
 	// different from having Poisson ruling the overall load impressed on the service.
 	// Note 2: Dropping requests made during pauses.
-	pauseTime := int64(0)
-	pauseChan := make(chan time.Duration)
-	for _, entry := range replayBook {
-		if pauseTime > 0 {
-			pauseTime -= entry.DelaySinceLastNanos
-			continue
-		} else {
-			pauseTime = 0
-		}
-
-		start := time.Now()
-
-		// Pretty simple thread-safe pool implementation.
-		client := <-r.clients
-
-		// Taking into account the time waiting for a free client.
-		delay := entry.DelaySinceLastNanos - (time.Now().Sub(start)).Nanoseconds()
-		if delay > 0 {
-			time.Sleep(time.Duration(delay))
-		}
-
+	pauseRemaining := make(map[*target]int64, len(r.targets))
+	pauseChan := make(chan pauseEvent)
+	r.offsets = newOffsetTracker()
+	for _, tgt := range r.targets {
 		wg.Add(1)
-		go func(entry loadspec.Entry, client *http.Client) {
+		go func(tgt *target) {
 			defer wg.Done()
-			defer func() {
-				r.clients <- client
-			}()
+			r.consumeTarget(ctx, shutdown, tgt, pauseChan, pacerRel, &wg)
+		}(tgt)
+	}
 
-			req, err := http.NewRequest(entry.Method, entry.URL, strings.NewReader(entry.Source))
-			if err != nil {
-				// TODO(danielfireman): Make this more elegant. Leveraging cobra error messages.
-				fmt.Printf("Error creating request: %q\n", err)
-				os.Exit(-1)
-				return
-			}
-			req.Header.Add("Content-Type", `application/json`)
+	var nextTarget uint64
+	prevDispatch := time.Now()
+	lastTick := time.Now()
+	i := 0
+dispatch:
+	for entry := range entries {
+		idx := i
+		i++
+		doneOffset := r.resumeOffset + int64(idx) + 1
 
-			if debug {
-				dReq, _ := httputil.DumpRequest(req, true)
-				fmt.Println(string(dReq))
+		tick := time.Now()
+		elapsed := tick.Sub(lastTick)
+		lastTick = tick
+		// Decrementing every paused target by actual elapsed wall time rather than pace, and on
+		// every entry rather than only on entries routed to it: under --pacing=closed:<n>, pace is
+		// always 0, and with several targets only a share of entries reach each one, so either
+		// would stretch a pause far past its duration.
+		for t, rem := range pauseRemaining {
+			if rem > 0 {
+				pauseRemaining[t] = rem - elapsed.Nanoseconds()
 			}
+		}
 
-			r.requestsSent.Inc()
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			defer cancel()
-			req.WithContext(ctx)
+		pace := pacer.Next(prevDispatch, entry)
 
-			resp, err := client.Do(req)
-			if err != nil {
-				r.errors.Inc()
-				fmt.Printf("Error sending request: %q\n", err)
-				return
-			}
+		tgt := r.selectTarget(&nextTarget)
+		r.offsets.Dispatch(doneOffset)
 
-			if debug {
-				dResp, _ := httputil.DumpResponse(resp, true)
-				fmt.Println(string(dResp))
+		if pauseRemaining[tgt] > 0 {
+			if isReleasingPacer {
+				pacerRel.Release()
 			}
+			// Dropped entries are never retried, so they're done the instant they're dropped:
+			// checkpoint past one now rather than leaving it in-flight forever.
+			r.recordProgress(entry.ID, r.offsets.Complete(doneOffset))
+			continue
+		}
 
-			defer resp.Body.Close()
-			code := resp.StatusCode
-			switch {
-			default:
-				r.errors.Inc()
-				r.perRequest.RequestProcessed(time.Now().Unix(), resp.StatusCode, 0, entry.ID)
-			case code == http.StatusOK:
-				searchResp := struct {
-					TookInMillis int64 `json:"took"`
-				}{}
-				if err := json.NewDecoder(resp.Body).Decode(&searchResp); err != nil {
-					fmt.Printf("error parsing response: %q\n", err)
-					// TODO(danielfireman): Make this more elegant. Leveraging cobra error messages.
-					os.Exit(-1)
-					return
-				}
-				r.responseTimes.Record(searchResp.TookInMillis)
-				r.perRequest.RequestProcessed(time.Now().Unix(), resp.StatusCode, searchResp.TookInMillis, entry.ID)
-
-			case code >= 400 && code < 500:
-				r.perRequest.RequestProcessed(time.Now().Unix(), resp.StatusCode, 0, entry.ID)
-				searchResp := struct {
-					Error struct {
-						Type   string `json:"type"`
-						Reason string `json:"reason"`
-					} `json:"error"`
-				}{}
-				if err := json.NewDecoder(resp.Body).Decode(&searchResp); err != nil {
-					fmt.Printf("error parsing bad request response: %q\n", err)
-					// TODO(danielfireman): Make this more elegant. Leveraging cobra error messages.
-					os.Exit(-1)
-					return
-				}
-				if !continueOn400 {
-					dReq, _ := httputil.DumpRequest(req, true)
-					fmt.Printf("error querying server:\nReq:%s\n Error:%+v\n", string(dReq), searchResp.Error)
-					// TODO(danielfireman): Make this more elegant. Leveraging cobra error messages.
-					os.Exit(-1)
-				}
-				r.errors.Inc()
-			case code == http.StatusServiceUnavailable || code == http.StatusTooManyRequests:
-				r.perRequest.RequestProcessed(time.Now().Unix(), resp.StatusCode, 0, entry.ID)
-				if atomic.LoadInt32(&isPaused) == 1 {
-					return
-				}
-				ra := resp.Header.Get("Retry-After")
-				if ra == "" {
-					// TODO(danielfireman): Make this more elegant. Leveraging cobra error messages.
-					fmt.Println("Could not extract retry-after information")
-					os.Exit(-1)
-				}
-				pt, err := strconv.ParseFloat(ra, 64)
-				if err != nil {
-					// TODO(danielfireman): Make this more elegant. Leveraging cobra error messages.
-					fmt.Println("Could not extract retry-after information")
-					os.Exit(-1)
-				}
-				pauseMillis := int64(pt * 1e3)
-				r.pauseTimes.Record(pauseMillis)
-				// If the loadtest is paused, ignore this signal.
-				if atomic.LoadInt32(&isPaused) == 1 {
-					return
-				}
-				// Only enqueue if the pause queue is empty.
-				if len(pauseChan) == 0 {
-					atomic.StoreInt32(&isPaused, 1)
-					pauseChan <- time.Duration(pauseMillis) * time.Millisecond
-				}
-			}
-		}(entry, client)
+		if wait := pace - time.Since(prevDispatch); wait > 0 {
+			time.Sleep(wait)
+		}
+		now := time.Now()
+		r.pacingIntervals.Record(now.Sub(prevDispatch).Nanoseconds() / int64(time.Millisecond))
+		prevDispatch = now
+
+		// Handing off to tgt's own queue instead of checking out a client here: the checkout now
+		// happens on tgt's dedicated consumeTarget goroutine, so a slow or exhausted target only
+		// ever stalls its own queued entries, never the other targets sharing this loop.
+		r.enqueue(ctx, tgt, dispatchJob{entry: entry, doneOffset: doneOffset})
 
-		// Non-blocking check of pauses.
+		// Non-blocking check of pauses. A pause on one target only affects that target's
+		// entries going forward; other targets keep dispatching at full speed.
 		select {
-		case pt := <-pauseChan:
-			pauseTime = pt.Nanoseconds()
-			time.Sleep(pt)
-			atomic.StoreInt32(&isPaused, 0)
-		case <-sig:
-			fmt.Println("Interrupting load test.")
-			return nil
+		case ev := <-pauseChan:
+			pauseRemaining[ev.tgt] = ev.dur.Nanoseconds()
+			atomic.StoreInt32(&ev.tgt.isPaused, 0)
+		case <-shutdown.Done():
+			break dispatch
 		default:
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return err
+	for _, tgt := range r.targets {
+		close(tgt.queue)
 	}
+
 	go func() {
 		wg.Wait()
 		close(pauseChan)
 	}()
-	// Avoiding any goroutine to be blocked on adding to the pause channel
-	for range pauseChan {
+	// Avoiding any goroutine to be blocked on adding to the pause channel.
+	go func() {
+		for range pauseChan {
+		}
+		close(done)
+	}()
+	return shutdown.Wait(done, r.forceCloseIdle)
+}
+
+// enqueue hands job off to tgt's queue. When tgt's queue is already full, the send blocks the
+// shared dispatch loop until tgt's consumeTarget goroutine makes room: that bounds entry backlog
+// (and the memory it pins) to the queue's capacity, unlike spawning a new goroutine per overflow
+// entry, which would let an indefinitely stalled target accumulate an unbounded number of them.
+func (r *runner) enqueue(ctx context.Context, tgt *target, job dispatchJob) {
+	select {
+	case tgt.queue <- job:
+	case <-ctx.Done():
+	}
+}
+
+// recordProgress checkpoints safe, the offset an offsetTracker.Complete call returned once an
+// entry finished, tagging it with that entry's id for the --resume_from log line.
+func (r *runner) recordProgress(id, safe int64) {
+	if err := r.checkpoint.Record(id, safe); err != nil {
+		fmt.Printf("Error persisting checkpoint: %q\n", err)
+	}
+}
+
+// consumeTarget is tgt's dedicated client-checkout and dispatch goroutine. Moving the checkout of
+// tgt.clients here, off the shared dispatch loop, means a slow or exhausted target only ever
+// delays its own queued entries; every other target keeps checking out clients and dispatching at
+// full speed. It returns once tgt.queue is closed and drained, or as soon as ctx is done, in which
+// case entries still buffered in tgt.queue are never sent.
+func (r *runner) consumeTarget(ctx context.Context, shutdown *Shutdown, tgt *target, pauseChan chan<- pauseEvent, pacerRel releaser, wg *sync.WaitGroup) {
+	for {
+		select {
+		case job, ok := <-tgt.queue:
+			if !ok {
+				return
+			}
+			select {
+			case conn := <-tgt.clients:
+				wg.Add(1)
+				go func(job dispatchJob, conn *clientConn) {
+					defer wg.Done()
+					r.handleRequest(ctx, shutdown, job, conn, tgt, pauseChan, pacerRel)
+				}(job, conn)
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleRequest sends job's request to tgt using conn, then checks conn back into tgt.clients and
+// checkpoints job's offset once it's safe to (every entry dispatched at or before it has also
+// completed; see offsetTracker). It always runs on a goroutine started by tgt's consumeTarget, so it can
+// only ever be delayed by its own target's pool and backoff state, never by another target's.
+func (r *runner) handleRequest(ctx context.Context, shutdown *Shutdown, job dispatchJob, conn *clientConn, tgt *target, pauseChan chan<- pauseEvent, pacerRel releaser) {
+	entry := job.entry
+	defer func() {
+		tgt.clients <- conn
+	}()
+	defer func() { r.recordProgress(entry.ID, r.offsets.Complete(job.doneOffset)) }()
+	if pacerRel != nil {
+		defer pacerRel.Release()
+	}
+
+	reqURL, err := tgt.rewriteURL(entry.URL)
+	if err != nil {
+		shutdown.Fail(fmt.Errorf("rewriting request URL for target %q: %v", tgt.label, err))
+		return
+	}
+
+	body, encoding := r.compressBody(conn.gzw, entry.Source)
+
+	req, err := http.NewRequest(entry.Method, reqURL, body)
+	if err != nil {
+		shutdown.Fail(fmt.Errorf("creating request: %v", err))
+		return
+	}
+	req.Header.Add("Content-Type", `application/json`)
+	if encoding != "" {
+		req.Header.Add("Content-Encoding", encoding)
+	}
+
+	if debug {
+		dReq, _ := httputil.DumpRequest(req, true)
+		fmt.Println(string(dReq))
+	}
+
+	r.requestsSent.Inc()
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req = req.WithContext(reqCtx)
+
+	resp, err := conn.client.Do(req)
+	if err != nil {
+		tgt.errors.Inc()
+		fmt.Printf("Error sending request: %q\n", err)
+		return
+	}
+
+	if debug {
+		dResp, _ := httputil.DumpResponse(resp, true)
+		fmt.Println(string(dResp))
+	}
+
+	defer resp.Body.Close()
+	code := resp.StatusCode
+	switch {
+	case code >= 500 && code != http.StatusServiceUnavailable:
+		tgt.errors.Inc()
+		r.perRequest.RequestProcessed(time.Now().Unix(), resp.StatusCode, 0, entry.ID)
+		if atomic.LoadInt32(&tgt.isPaused) == 1 {
+			return
+		}
+		n := atomic.AddUint32(&tgt.backoff, 1)
+		d := backoffDelay(n - 1)
+		tgt.pauseTimes.Record(d.Nanoseconds() / int64(time.Millisecond))
+		atomic.StoreInt32(&tgt.isPaused, 1)
+		pauseChan <- pauseEvent{tgt: tgt, dur: d}
+	default:
+		tgt.errors.Inc()
+		r.perRequest.RequestProcessed(time.Now().Unix(), resp.StatusCode, 0, entry.ID)
+	case code == http.StatusOK:
+		atomic.StoreUint32(&tgt.backoff, 0)
+		searchResp := struct {
+			TookInMillis int64 `json:"took"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&searchResp); err != nil {
+			shutdown.Fail(fmt.Errorf("error parsing response: %v", err))
+			return
+		}
+		r.responseTimes.Record(searchResp.TookInMillis)
+		r.perRequest.RequestProcessed(time.Now().Unix(), resp.StatusCode, searchResp.TookInMillis, entry.ID)
+
+	case code >= 400 && code < 500 && code != http.StatusTooManyRequests:
+		r.perRequest.RequestProcessed(time.Now().Unix(), resp.StatusCode, 0, entry.ID)
+		searchResp := struct {
+			Error struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&searchResp); err != nil {
+			shutdown.Fail(fmt.Errorf("error parsing bad request response: %v", err))
+			return
+		}
+		if !continueOn400 {
+			dReq, _ := httputil.DumpRequest(req, true)
+			shutdown.Fail(fmt.Errorf("error querying server:\nReq:%s\n Error:%+v", string(dReq), searchResp.Error))
+			return
+		}
+		tgt.errors.Inc()
+	case code == http.StatusServiceUnavailable || code == http.StatusTooManyRequests:
+		r.perRequest.RequestProcessed(time.Now().Unix(), resp.StatusCode, 0, entry.ID)
+		if atomic.LoadInt32(&tgt.isPaused) == 1 {
+			return
+		}
+		ra := resp.Header.Get("Retry-After")
+		if ra == "" {
+			shutdown.Fail(fmt.Errorf("could not extract retry-after information"))
+			return
+		}
+		pt, err := strconv.ParseFloat(ra, 64)
+		if err != nil {
+			shutdown.Fail(fmt.Errorf("could not extract retry-after information: %v", err))
+			return
+		}
+		pauseMillis := int64(pt * 1e3)
+		tgt.pauseTimes.Record(pauseMillis)
+		// If this target is already paused, ignore this signal.
+		if atomic.LoadInt32(&tgt.isPaused) == 1 {
+			return
+		}
+		atomic.StoreInt32(&tgt.isPaused, 1)
+		pauseChan <- pauseEvent{tgt: tgt, dur: time.Duration(pauseMillis) * time.Millisecond}
+	}
+}
+
+// forceCloseIdle closes every target's idle connections, used as the shutdown coordinator's
+// last resort when in-flight work doesn't drain within --shutdown_timeout.
+func (r *runner) forceCloseIdle() {
+	for _, tgt := range r.targets {
+		tgt.Close()
 	}
-	return nil
 }
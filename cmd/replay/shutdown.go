@@ -0,0 +1,126 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// closer is the subset of io.Closer that reporter.Reporter and reporter.PerRequestReport satisfy
+// through their Finish methods, adapted with closerFunc below.
+type closer interface {
+	Close() error
+}
+
+// closerFunc adapts a plain func() error into a closer, so reporter.Reporter.Finish and
+// reporter.PerRequestReport.Finish can be registered with Shutdown without changing their
+// signature.
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// Shutdown coordinates graceful termination of a replay run. It cancels the context propagated
+// into every client.Do call as soon as SIGINT/SIGTERM/SIGHUP arrives, a worker reports a fatal
+// error via Fail, or the run completes normally, then gives in-flight goroutines up to a
+// configurable drain timeout to finish and flush their CSV writers before forcing idle
+// connections closed.
+type Shutdown struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+	errCh   chan error
+	closers []closer
+}
+
+// NewShutdown builds a Shutdown coordinator around ctx/cancel, watching for termination signals
+// in the background so the dispatch loop only ever needs to watch ctx.Done(). Call cancel to stop
+// watching before the process exits normally.
+func NewShutdown(ctx context.Context, cancel context.CancelFunc, timeout time.Duration) *Shutdown {
+	s := &Shutdown{
+		ctx:     ctx,
+		cancel:  cancel,
+		timeout: timeout,
+		errCh:   make(chan error, 1),
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		select {
+		case <-sig:
+			fmt.Println("Interrupting load test.")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return s
+}
+
+// Register adds c to the set of closers flushed during Wait, in registration order.
+func (s *Shutdown) Register(c closer) {
+	s.closers = append(s.closers, c)
+}
+
+// Fail requests a shutdown that surfaces err as the run's result, in place of the os.Exit(-1)
+// calls this replaced. It is safe to call more than once; only the first error is kept.
+func (s *Shutdown) Fail(err error) {
+	select {
+	case s.errCh <- err:
+		s.cancel()
+	default:
+	}
+}
+
+// Done returns the channel the dispatch loop should select on to know when to stop producing new
+// requests: a signal, a Fail, or Wait being asked to stop for any other reason.
+func (s *Shutdown) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Wait blocks until done closes (normal completion), a signal or Fail cancels the context, or
+// done closes first regardless. Either way it then waits up to timeout for done to close before
+// invoking forceClose to drop idle connections so a stuck transport can't block shutdown forever.
+// forceClose only closes idle connections, never one actively serving a request, so Wait then
+// gives those in-flight requests one more timeout window to notice the canceled context and
+// finish on their own; if they still haven't by the end of it, Wait gives up on draining and
+// returns instead of blocking RunE forever, surfacing a non-zero error if none was already set.
+// Either way it always runs the registered closers before returning.
+func (s *Shutdown) Wait(done <-chan struct{}, forceClose func()) error {
+	var err error
+	select {
+	case err = <-s.errCh:
+	case <-s.ctx.Done():
+	case <-done:
+	}
+	if err == nil {
+		// Fail cancels the context right after queuing its error, so the select above may
+		// have taken ctx.Done first.
+		select {
+		case err = <-s.errCh:
+		default:
+		}
+	}
+	s.cancel()
+
+	select {
+	case <-done:
+	case <-time.After(s.timeout):
+		forceClose()
+		select {
+		case <-done:
+		case <-time.After(s.timeout):
+			if err == nil {
+				err = fmt.Errorf("shutdown: in-flight requests did not drain within %s of forcing idle connections closed", s.timeout)
+			}
+		}
+	}
+
+	for _, c := range s.closers {
+		if cErr := c.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	return err
+}